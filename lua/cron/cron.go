@@ -0,0 +1,251 @@
+// Package cron schedules Lua callbacks to run on a cron-style schedule or a
+// fixed interval. Each invocation gets its own *lua.LState, cloned from the
+// template state (the first state that Load was called with), so globals such as DB handles and OllamaClients
+// set up at startup remain usable from background jobs, and unrelated jobs
+// can run concurrently instead of piling up behind one shared state.
+//
+// A gopher-lua closure normally resolves its globals through the
+// *lua.LState that compiled it (cf.Fn.Env), not through whatever state
+// happens to invoke it, so simply copying globals into a cloned state's
+// global table would not be enough to make a job see them: SetFEnv is used
+// to re-point the scheduled function's Env at the clone's global table
+// before every run, so its global lookups actually resolve there.
+package cron
+
+import (
+	"sync"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/mssql"
+	"github.com/xyproto/algernon/lua/ollama"
+	"github.com/xyproto/algernon/lua/pquery"
+	"github.com/xyproto/algernon/lua/sqldb"
+	"github.com/xyproto/algernon/lua/vectorstore"
+	lua "github.com/xyproto/gopher-lua"
+)
+
+// job is a single scheduled Lua callback. mut serializes repeated
+// executions of this one job, since a scheduled firing can race with an
+// on-demand cron.run(id) call; it does not affect other jobs, which run
+// concurrently on their own cloned states.
+type job struct {
+	id      int
+	spec    string
+	fn      *lua.LFunction
+	entryID cron.EntryID
+	mut     sync.Mutex
+}
+
+// jobInfo is a snapshot of a job's id and spec for cron.list(), safe to
+// copy (unlike job, which embeds a mutex).
+type jobInfo struct {
+	id   int
+	spec string
+}
+
+// registry tracks every scheduled job, plus the cron.Cron scheduler driving them.
+type registry struct {
+	mut      sync.Mutex
+	c        *cron.Cron
+	template *lua.LState
+	jobs     map[int]*job
+	nextID   int
+}
+
+func newRegistry(template *lua.LState) *registry {
+	r := &registry{
+		c:        cron.New(),
+		template: template,
+		jobs:     make(map[int]*job),
+	}
+	r.c.Start()
+	return r
+}
+
+// cloneState creates a fresh *lua.LState carrying over the globals of the
+// registry's template state (the first state that Load was called with, not
+// necessarily the one that scheduled the job), so the job can still see DB handles,
+// OllamaClients and other userdata that were set up at startup. It also
+// re-registers the type metatables for every package a job might construct
+// new userdata from, since a metatable set up via L.NewTypeMetatable lives
+// only in the *lua.LState it was registered into, not in the clone.
+func cloneState(template *lua.LState) *lua.LState {
+	clone := lua.NewState()
+	sqldb.Load(clone)
+	mssql.Load(clone)
+	pquery.Load(clone)
+	ollama.Load(clone)
+	vectorstore.Load(clone)
+	template.G.Global.ForEach(func(k, v lua.LValue) {
+		clone.SetGlobal(k.String(), v)
+	})
+	return clone
+}
+
+// run executes j's callback in its own cloned Lua state, recovering from
+// and logging any panic. j.mut only serializes repeated executions of this
+// one job; other jobs run on their own clones and are unaffected.
+func (r *registry) run(j *job) {
+	j.mut.Lock()
+	defer j.mut.Unlock()
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Error("cron job panicked: ", rec)
+		}
+	}()
+	L := cloneState(r.template)
+	defer L.Close()
+	// Re-point the callback's global lookups at the clone (see the package
+	// doc comment for why this is needed in addition to cloning).
+	L.SetFEnv(j.fn, L.G.Global)
+	if err := L.CallByParam(lua.P{
+		Fn:      j.fn,
+		NRet:    0,
+		Protect: true,
+	}); err != nil {
+		log.Error("cron job failed: " + err.Error())
+	}
+}
+
+// add registers fn under the given cron spec (or an "@every ..."-style
+// descriptor) and returns its job id.
+func (r *registry) add(spec string, fn *lua.LFunction) (int, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	id := r.nextID
+	j := &job{id: id, spec: spec, fn: fn}
+	entryID, err := r.c.AddFunc(spec, func() { r.run(j) })
+	if err != nil {
+		return 0, err
+	}
+	j.entryID = entryID
+	r.nextID++
+	r.jobs[id] = j
+	return id, nil
+}
+
+// remove unregisters the job with the given id, reporting whether it existed.
+func (r *registry) remove(id int) bool {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	j, ok := r.jobs[id]
+	if !ok {
+		return false
+	}
+	r.c.Remove(j.entryID)
+	delete(r.jobs, id)
+	return true
+}
+
+// runNow runs the job with the given id immediately, on demand, reporting whether it existed.
+func (r *registry) runNow(id int) bool {
+	r.mut.Lock()
+	j, ok := r.jobs[id]
+	r.mut.Unlock()
+	if !ok {
+		return false
+	}
+	r.run(j)
+	return true
+}
+
+// list returns the id and spec of every currently scheduled job.
+func (r *registry) list() []jobInfo {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	jobs := make([]jobInfo, 0, len(r.jobs))
+	for _, j := range r.jobs {
+		jobs = append(jobs, jobInfo{id: j.id, spec: j.spec})
+	}
+	return jobs
+}
+
+// reg is the single, process-wide job registry, created the first time Load
+// registers the cron functions into a Lua state.
+var (
+	regOnce sync.Once
+	reg     *registry
+)
+
+func getRegistry(L *lua.LState) *registry {
+	regOnce.Do(func() {
+		reg = newRegistry(L)
+	})
+	return reg
+}
+
+// cronSchedule implements schedule(spec, function), where spec is a 5-field
+// cron expression (or an "@hourly"/"@every 5m"-style descriptor).
+func cronSchedule(L *lua.LState) int {
+	spec := L.ToString(1)
+	fn := L.CheckFunction(2)
+	id, err := getRegistry(L).add(spec, fn)
+	if err != nil {
+		log.Error(err)
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(lua.LNumber(id))
+	return 1 // number of results
+}
+
+// cronEvery implements every(duration, function), where duration is a
+// Go-style duration string, eg. "5m" or "1h30m".
+func cronEvery(L *lua.LState) int {
+	duration := L.ToString(1)
+	fn := L.CheckFunction(2)
+	id, err := getRegistry(L).add("@every "+duration, fn)
+	if err != nil {
+		log.Error(err)
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	L.Push(lua.LNumber(id))
+	return 1 // number of results
+}
+
+// cronList implements cron.list(), returning a table of {id, spec} for every scheduled job.
+func cronList(L *lua.LState) int {
+	jobs := getRegistry(L).list()
+	tbl := L.NewTable()
+	for _, j := range jobs {
+		row := L.NewTable()
+		L.SetField(row, "id", lua.LNumber(j.id))
+		L.SetField(row, "spec", lua.LString(j.spec))
+		tbl.Append(row)
+	}
+	L.Push(tbl)
+	return 1 // number of results
+}
+
+// cronRemove implements cron.remove(id).
+func cronRemove(L *lua.LState) int {
+	ok := getRegistry(L).remove(L.ToInt(1))
+	L.Push(lua.LBool(ok))
+	return 1 // number of results
+}
+
+// cronRun implements cron.run(id), running the job on demand.
+func cronRun(L *lua.LState) int {
+	ok := getRegistry(L).runNow(L.ToInt(1))
+	L.Push(lua.LBool(ok))
+	return 1 // number of results
+}
+
+// Load makes the schedule/every functions and the cron table available to the given Lua state.
+func Load(L *lua.LState) {
+	getRegistry(L) // ensure the shared scheduler is running
+
+	L.SetGlobal("schedule", L.NewFunction(cronSchedule))
+	L.SetGlobal("every", L.NewFunction(cronEvery))
+
+	cronTable := L.NewTable()
+	L.SetField(cronTable, "list", L.NewFunction(cronList))
+	L.SetField(cronTable, "remove", L.NewFunction(cronRemove))
+	L.SetField(cronTable, "run", L.NewFunction(cronRun))
+	L.SetGlobal("cron", cronTable)
+}
@@ -0,0 +1,45 @@
+package mssql
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/sqldb"
+	lua "github.com/xyproto/gopher-lua"
+)
+
+// mssqlMigrationDialect supplies the MSSQL-specific SQL for the schema_migrations tracker table.
+var mssqlMigrationDialect = sqldb.MigrationDialect{
+	CreateTrackerTable: `IF OBJECT_ID('schema_migrations', 'U') IS NULL CREATE TABLE schema_migrations (version BIGINT NOT NULL PRIMARY KEY, dirty BIT NOT NULL DEFAULT 0)`,
+	SelectState:        `SELECT TOP 1 version, dirty FROM schema_migrations ORDER BY version DESC`,
+	DeleteState:        `DELETE FROM schema_migrations`,
+	InsertState:        `INSERT INTO schema_migrations (version, dirty) VALUES (@p1, @p2)`,
+}
+
+// mssqlMigrate exposes the migration runner to Lua as MSSQLMigrate(dir, connectionString, command, version).
+// command defaults to "up" and version is only used by "goto" and "force".
+func mssqlMigrate(L *lua.LState) int {
+	dir := L.ToString(1)
+	connectionString := defaultConnectionString
+	if L.GetTop() >= 2 {
+		connectionString = L.ToString(2)
+	}
+	command := "up"
+	if L.GetTop() >= 3 {
+		command = L.ToString(3)
+	}
+	target := 0
+	if L.GetTop() >= 4 {
+		target = L.ToInt(4)
+	}
+	db, err := getConnection(connectionString)
+	if err != nil {
+		logrus.Error("Could not connect to database using " + connectionString + ": " + err.Error())
+		L.Push(lua.LString(err.Error()))
+		return 1 // number of results
+	}
+	if err := sqldb.Migrate(db, mssqlMigrationDialect, dir, command, target); err != nil {
+		logrus.Error("MSSQL migration failed: " + err.Error())
+		L.Push(lua.LString(err.Error()))
+		return 1 // number of results
+	}
+	return 0 // number of results
+}
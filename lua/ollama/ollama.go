@@ -258,15 +258,18 @@ func constructOllamaClient(L *lua.LState) (*lua.LUserData, error) {
 
 // The hash map methods that are to be registered
 var ollamaMethods = map[string]lua.LGFunction{
-	"ask":        ollamaGenerateOutput,
-	"bytesize":   ollamaSizeInBytes,
-	"creative":   ollamaGenerateOutputCreative,
-	"has":        ollamaHas,
-	"list":       ollamaList,
-	"model":      ollamaModel, // set or get the current model, but don't pull anything
-	"pull":       ollamaPullIfNeeded,
-	"size":       ollamaSize,
-	"embeddings": ollamaEmbeddings, // get a []float64 representation of a given prompt
+	"ask":             ollamaGenerateOutput,
+	"bytesize":        ollamaSizeInBytes,
+	"creative":        ollamaGenerateOutputCreative,
+	"has":             ollamaHas,
+	"list":            ollamaList,
+	"model":           ollamaModel, // set or get the current model, but don't pull anything
+	"pull":            ollamaPullIfNeeded,
+	"size":            ollamaSize,
+	"embeddings":      ollamaEmbeddings,     // get a []float64 representation of a given prompt
+	"stream":          ollamaStream,         // stream output, invoking a callback per chunk
+	"stream_creative": ollamaStreamCreative, // like stream, but calls SetRandom on the client first
+	"cancel":          ollamaCancel,         // abort this client's in-flight stream, if any
 }
 
 func askOllama(L *lua.LState) int {
@@ -298,6 +301,33 @@ func askOllama(L *lua.LState) int {
 	return 1 // number of results
 }
 
+// CosineDistance calculates the cosine distance between two embeddings.
+// Cosine similarity ranges from -1 to 1, so the returned distance ranges from 0 to 2,
+// with lower values meaning more similarity.
+func CosineDistance(a, b []float64) (float64, error) {
+	if len(a) != len(b) {
+		return 0, fmt.Errorf("embeddings must be of the same length")
+	}
+
+	dotProduct := 0.0
+	normA := 0.0
+	normB := 0.0
+	for i := range a {
+		dotProduct += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	normA = math.Sqrt(normA)
+	normB = math.Sqrt(normB)
+
+	if normA == 0.0 || normB == 0.0 {
+		return 0, fmt.Errorf("one or both vectors are zero vectors")
+	}
+
+	cosineSimilarity := dotProduct / (normA * normB)
+	return 1 - cosineSimilarity, nil
+}
+
 // distance calculates the cosine similarity between two embeddings (Lua tables of floats).
 func distance(L *lua.LState) int {
 	// Check and get the first table argument
@@ -317,33 +347,11 @@ func distance(L *lua.LState) int {
 		return 1 // number of results (error message)
 	}
 
-	// Calculate the cosine similarity
-	if len(slice1) != len(slice2) {
-		L.Push(lua.LString("error: embeddings must be of the same length"))
+	cosineDistance, err := CosineDistance(slice1, slice2)
+	if err != nil {
+		L.Push(lua.LString("error: " + err.Error()))
 		return 1 // number of results (error message)
 	}
-
-	dotProduct := 0.0
-	normA := 0.0
-	normB := 0.0
-	for i := range slice1 {
-		dotProduct += slice1[i] * slice2[i]
-		normA += slice1[i] * slice1[i]
-		normB += slice2[i] * slice2[i]
-	}
-	normA = math.Sqrt(normA)
-	normB = math.Sqrt(normB)
-
-	if normA == 0.0 || normB == 0.0 {
-		L.Push(lua.LString("error: one or both vectors are zero vectors"))
-		return 1 // number of results
-	}
-
-	cosineSimilarity := dotProduct / (normA * normB)
-
-	// Cosine similarity ranges from -1 to 1, higher values mean more similarity
-	// We convert it to a distance measure that ranges from 0 to 2
-	cosineDistance := 1 - cosineSimilarity
 	L.Push(lua.LNumber(cosineDistance))
 	return 1 // number of results (distance)
 }
@@ -0,0 +1,214 @@
+package ollama
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	lua "github.com/xyproto/gopher-lua"
+	"github.com/xyproto/ollamaclient/v2"
+)
+
+// defaultServerAddr is used when a client has not been given an explicit ServerAddr.
+const defaultServerAddr = "http://localhost:11434"
+
+// generateRequest is the request body for Ollama's streaming /api/generate endpoint.
+type generateRequest struct {
+	Model  string `json:"model"`
+	Prompt string `json:"prompt"`
+	Stream bool   `json:"stream"`
+}
+
+// generateChunk is a single newline-delimited JSON object from the streaming response.
+type generateChunk struct {
+	Response      string `json:"response"`
+	Done          bool   `json:"done"`
+	EvalCount     int    `json:"eval_count"`
+	EvalDuration  int64  `json:"eval_duration"`
+	TotalDuration int64  `json:"total_duration"`
+}
+
+// streamCancelFuncs tracks the cancel functions for each client's in-flight
+// streams, if any, so that oc:cancel() can abort them from another
+// goroutine. A client's OllamaClient is long-lived and shared (userdata
+// created at startup, reused by cron jobs and requests alike), so more than
+// one oc:stream()/oc:stream_creative() call can be in flight for the same
+// *ollamaclient.Config at once; each is tracked under its own token so that
+// one call finishing doesn't drop another, still-running call's entry.
+var (
+	streamCancelMut   sync.Mutex
+	streamCancelNext  uint64
+	streamCancelFuncs = make(map[*ollamaclient.Config]map[uint64]context.CancelFunc)
+)
+
+func setStreamCancel(oc *ollamaclient.Config, cancel context.CancelFunc) uint64 {
+	streamCancelMut.Lock()
+	defer streamCancelMut.Unlock()
+	streamCancelNext++
+	token := streamCancelNext
+	if streamCancelFuncs[oc] == nil {
+		streamCancelFuncs[oc] = make(map[uint64]context.CancelFunc)
+	}
+	streamCancelFuncs[oc][token] = cancel
+	return token
+}
+
+func clearStreamCancel(oc *ollamaclient.Config, token uint64) {
+	streamCancelMut.Lock()
+	defer streamCancelMut.Unlock()
+	if tokens, ok := streamCancelFuncs[oc]; ok {
+		delete(tokens, token)
+		if len(tokens) == 0 {
+			delete(streamCancelFuncs, oc)
+		}
+	}
+}
+
+// streamGenerate issues a streaming /api/generate request and invokes callback
+// for every decoded chunk, as it arrives. Each invocation is serialized under
+// mut, since a lua.LState may not be used concurrently. serverAddr and
+// modelName must be snapshotted under mut by the caller, since oc's fields
+// may be mutated concurrently from another request.
+func streamGenerate(L *lua.LState, oc *ollamaclient.Config, serverAddr, modelName, prompt string, callback *lua.LFunction, timeout time.Duration) error {
+	if serverAddr == "" {
+		serverAddr = defaultServerAddr
+	}
+
+	ctx := context.Background()
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	token := setStreamCancel(oc, cancel)
+	defer func() {
+		clearStreamCancel(oc, token)
+		cancel()
+	}()
+
+	body, err := json.Marshal(generateRequest{Model: modelName, Prompt: prompt, Stream: true})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(serverAddr, "/")+"/api/generate", strings.NewReader(string(body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var chunk generateChunk
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			log.Error("Failed to decode Ollama stream chunk: " + err.Error())
+			continue
+		}
+
+		stats := L.NewTable()
+		L.SetField(stats, "done", lua.LBool(chunk.Done))
+		L.SetField(stats, "eval_count", lua.LNumber(chunk.EvalCount))
+		L.SetField(stats, "eval_duration", lua.LNumber(chunk.EvalDuration))
+		L.SetField(stats, "total_duration", lua.LNumber(chunk.TotalDuration))
+
+		mut.Lock()
+		callErr := L.CallByParam(lua.P{
+			Fn:      callback,
+			NRet:    0,
+			Protect: true,
+		}, lua.LString(chunk.Response), stats)
+		mut.Unlock()
+		if callErr != nil {
+			return callErr
+		}
+
+		if chunk.Done {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return ctx.Err()
+}
+
+// runStream implements oc:stream(prompt, callback, [timeout]) and
+// oc:stream_creative(prompt, callback, [timeout]). timeout is given in seconds.
+// The request carries only the model, the prompt and the stream flag: the
+// sampling settings that SetReproducible and SetRandom put on oc are not
+// sent, so stream and stream_creative get the same server-side sampling.
+func runStream(L *lua.LState, creative bool) int {
+	oc := checkOllamaClient(L) // arg 1
+	prompt := defaultPrompt
+	if L.GetTop() >= 2 {
+		prompt = L.ToString(2)
+	}
+	callback := L.CheckFunction(3)
+	var timeout time.Duration
+	if L.GetTop() >= 4 {
+		timeout = time.Duration(L.ToInt64(4)) * time.Second
+	}
+
+	mut.Lock()
+	if creative {
+		oc.SetRandom()
+	} else {
+		oc.SetReproducible()
+	}
+	serverAddr := oc.ServerAddr
+	modelName := oc.ModelName
+	mut.Unlock()
+
+	if err := streamGenerate(L, oc, serverAddr, modelName, prompt, callback, timeout); err != nil {
+		log.Error(err)
+		L.Push(lua.LString(err.Error()))
+		return 1 // number of results
+	}
+	return 0 // number of results
+}
+
+// ollamaStream streams generation output for a prompt, invoking callback with
+// each partial chunk and a table of {done, eval_count, eval_duration, total_duration}.
+func ollamaStream(L *lua.LState) int {
+	return runStream(L, false)
+}
+
+// ollamaStreamCreative is like ollamaStream, but calls SetRandom on the client
+// instead of SetReproducible (see runStream for what reaches the request).
+func ollamaStreamCreative(L *lua.LState) int {
+	return runStream(L, true)
+}
+
+// ollamaCancel aborts every in-flight stream for this client, if any.
+func ollamaCancel(L *lua.LState) int {
+	oc := checkOllamaClient(L) // arg 1
+	streamCancelMut.Lock()
+	cancels := make([]context.CancelFunc, 0, len(streamCancelFuncs[oc]))
+	for _, cancel := range streamCancelFuncs[oc] {
+		cancels = append(cancels, cancel)
+	}
+	streamCancelMut.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return 0 // number of results
+}
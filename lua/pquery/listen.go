@@ -0,0 +1,118 @@
+package pquery
+
+import (
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	lua "github.com/xyproto/gopher-lua"
+)
+
+const (
+	listenerMinReconnect = 10 * time.Second
+	listenerMaxReconnect = time.Minute
+)
+
+// listenMut serializes every Lua callback invocation dispatched from a
+// PQListen goroutine, since a lua.LState may not be used concurrently.
+var listenMut sync.Mutex
+
+// listeners tracks every *pq.Listener started by PQListen, keyed by the id
+// handed back to Lua, so that PQUnlisten can stop one on demand. This also
+// bounds the lifetime of the dispatch goroutine to something that outlives a
+// single request: without an explicit PQUnlisten call the listener (and its
+// goroutine) keeps running against whichever *lua.LState was live when
+// PQListen was called, for as long as the process is up.
+var (
+	listenerMut    sync.Mutex
+	listenerNextID int
+	listeners      = make(map[int]*pq.Listener)
+)
+
+// addListener registers listener under a fresh id and returns it.
+func addListener(listener *pq.Listener) int {
+	listenerMut.Lock()
+	defer listenerMut.Unlock()
+	listenerNextID++
+	id := listenerNextID
+	listeners[id] = listener
+	return id
+}
+
+// removeListener closes and unregisters the listener with the given id,
+// reporting whether it existed.
+func removeListener(id int) bool {
+	listenerMut.Lock()
+	listener, ok := listeners[id]
+	if ok {
+		delete(listeners, id)
+	}
+	listenerMut.Unlock()
+	if !ok {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// pqListen implements PQListen(channel, callback, connectionString), which
+// returns an id that can later be passed to PQUnlisten(id) to stop it.
+// callback is invoked with (channel, payload) for every NOTIFY received on
+// channel, until the listener is stopped.
+func pqListen(L *lua.LState) int {
+	channel := L.ToString(1)
+	callback := L.CheckFunction(2)
+	connectionString := defaultConnectionString
+	if L.GetTop() >= 3 {
+		connectionString = L.ToString(3)
+	}
+
+	listener := pq.NewListener(connectionString, listenerMinReconnect, listenerMaxReconnect, func(_ pq.ListenerEventType, err error) {
+		if err != nil {
+			logrus.Error("PQListen: " + err.Error())
+		}
+	})
+	if err := listener.Listen(channel); err != nil {
+		logrus.Error("PQListen: could not listen on channel " + channel + ": " + err.Error())
+		listener.Close()
+		L.Push(lua.LString(err.Error()))
+		return 1 // number of results
+	}
+
+	id := addListener(listener)
+
+	go func() {
+		defer func() {
+			if rec := recover(); rec != nil {
+				logrus.Error("PQListen callback panicked: ", rec)
+			}
+		}()
+		for notification := range listener.Notify {
+			if notification == nil {
+				continue
+			}
+			listenMut.Lock()
+			err := L.CallByParam(lua.P{
+				Fn:      callback,
+				NRet:    0,
+				Protect: true,
+			}, lua.LString(notification.Channel), lua.LString(notification.Extra))
+			listenMut.Unlock()
+			if err != nil {
+				logrus.Error("PQListen callback failed: " + err.Error())
+			}
+		}
+	}()
+
+	L.Push(lua.LNumber(id))
+	return 1 // number of results
+}
+
+// pqUnlisten implements PQUnlisten(id), stopping the listener started by the
+// matching PQListen call and reporting whether it was still running.
+func pqUnlisten(L *lua.LState) int {
+	ok := removeListener(L.ToInt(1))
+	L.Push(lua.LBool(ok))
+	return 1 // number of results
+}
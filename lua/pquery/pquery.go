@@ -3,26 +3,61 @@ package pquery
 import (
 	"database/sql"
 	"strings"
-	"sync"
 
+	// Using the PostgreSQL database engine
+	"github.com/lib/pq"
 	"github.com/sirupsen/logrus"
-	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/lua/sqldb"
 	lua "github.com/xyproto/gopher-lua"
-
-	// Using the PostgreSQL database engine
-	_ "github.com/lib/pq"
 )
 
 const (
+	driverName              = "postgres"
 	defaultQuery            = "SELECT version()"
 	defaultConnectionString = "host=localhost port=5432 user=postgres dbname=test sslmode=disable"
 )
 
-var (
-	// global map from connection string to database connection, to reuse connections, protected by a mutex
-	reuseDB  = make(map[string]*sql.DB)
-	reuseMut = &sync.RWMutex{}
-)
+// getConnection returns a cached *sql.DB for the given connection string,
+// reusing the connection pool shared with SQL()/sql.open().
+func getConnection(connectionString string) (*sql.DB, error) {
+	return sqldb.GetConnection(driverName, connectionString)
+}
+
+// queryArgsFromTable turns a Lua table argument into query parameters:
+// numeric keys become positional $1, $2, ... parameters (tables become
+// pq.Array values) and string keys become named parameters.
+func queryArgsFromTable(L *lua.LState, index int) []any {
+	var queryArgs []any
+	if L.GetTop() < index {
+		return queryArgs
+	}
+	table := L.ToTable(index)
+	if table == nil {
+		return queryArgs
+	}
+	table.ForEach(func(k, v lua.LValue) {
+		switch k.Type() {
+		case lua.LTNumber:
+			if arr, ok := v.(*lua.LTable); ok {
+				queryArgs = append(queryArgs, pq.Array(luaArrayToStrings(arr)))
+			} else {
+				queryArgs = append(queryArgs, v.String())
+			}
+		case lua.LTString:
+			queryArgs = append(queryArgs, sql.Named(k.String(), v.String()))
+		}
+	})
+	return queryArgs
+}
+
+// luaArrayToStrings converts a Lua array table to a []string, for use with pq.Array.
+func luaArrayToStrings(t *lua.LTable) []string {
+	var out []string
+	t.ForEach(func(_, v lua.LValue) {
+		out = append(out, v.String())
+	})
+	return out
+}
 
 // Load makes functions related to building a library of Lua code available
 func Load(L *lua.LState) {
@@ -41,43 +76,15 @@ func Load(L *lua.LState) {
 		if L.GetTop() >= 2 {
 			connectionString = L.ToString(2)
 		}
+		queryArgs := queryArgsFromTable(L, 3)
 
-		// Check if there is a connection that can be reused
-		var db *sql.DB
-		reuseMut.RLock()
-		conn, ok := reuseDB[connectionString]
-		reuseMut.RUnlock()
-
-		if ok {
-			// It exists, but is it still alive?
-			err := conn.Ping()
-			if err != nil {
-				// no
-				reuseMut.Lock()
-				delete(reuseDB, connectionString)
-				reuseMut.Unlock()
-			} else {
-				// yes
-				db = conn
-			}
-		}
-		// Create a new connection, if needed
-		var err error
-		if db == nil {
-			db, err = sql.Open("postgres", connectionString)
-			if err != nil {
-				logrus.Error("Could not connect to database using " + connectionString + ": " + err.Error())
-				return 0 // No results
-			}
-			// Save the connection for later
-			reuseMut.Lock()
-			reuseDB[connectionString] = db
-			reuseMut.Unlock()
+		db, err := getConnection(connectionString)
+		if err != nil {
+			logrus.Error("Could not connect to database using " + connectionString + ": " + err.Error())
+			return 0 // No results
 		}
-		// logrus.Info(fmt.Sprintf("PostgreSQL database: %v (%T)\n", db, db))
-		reuseMut.Lock()
-		rows, err := db.Query(query)
-		reuseMut.Unlock()
+		// Return the rows as typed column maps, instead of just strings
+		table, err := sqldb.QueryCached(L, db, driverName+"\x00"+connectionString, query, queryArgs)
 		if err != nil {
 			errMsg := err.Error()
 			if strings.Contains(errMsg, ": connect: connection refused") {
@@ -94,27 +101,48 @@ func Load(L *lua.LState) {
 			}
 			return 0 // No results
 		}
-		if rows == nil {
-			// Return an empty table
-			L.Push(L.NewTable())
-			return 1 // number of results
-		}
-		// Return the rows as a table
-		var (
-			values []string
-			value  string
-		)
-		for rows.Next() {
-			err = rows.Scan(&value)
-			if err != nil {
-				break
-			}
-			values = append(values, value)
-		}
-		// Convert the strings to a Lua table
-		table := convert.Strings2table(L, values)
-		// Return the table
 		L.Push(table)
 		return 1 // number of results
 	}))
+
+	// Register the PQMigrate function: PQMigrate(dir, connectionString, command, version)
+	L.SetGlobal("PQMigrate", L.NewFunction(pqMigrate))
+
+	// Register the PQExec function: PQExec(sql, connectionString, args)
+	L.SetGlobal("PQExec", L.NewFunction(pqExec))
+
+	// Register the PQListen function: PQListen(channel, callback, connectionString)
+	L.SetGlobal("PQListen", L.NewFunction(pqListen))
+
+	// Register the PQUnlisten function: PQUnlisten(id)
+	L.SetGlobal("PQUnlisten", L.NewFunction(pqUnlisten))
+}
+
+// pqExec runs an INSERT/UPDATE/DELETE statement and returns rows_affected, last_insert_id.
+func pqExec(L *lua.LState) int {
+	query := L.ToString(1)
+	connectionString := defaultConnectionString
+	if L.GetTop() >= 2 {
+		connectionString = L.ToString(2)
+	}
+	queryArgs := queryArgsFromTable(L, 3)
+
+	db, err := getConnection(connectionString)
+	if err != nil {
+		logrus.Error("Could not connect to database using " + connectionString + ": " + err.Error())
+		L.Push(lua.LNumber(0))
+		L.Push(lua.LNumber(0))
+		return 2 // number of results
+	}
+	rowsAffected, lastInsertID, err := sqldb.ExecCached(db, driverName+"\x00"+connectionString, query, queryArgs)
+	if err != nil { // lastInsertID is not supported by lib/pq, stays 0
+		logrus.Error("PQExec query: " + query)
+		logrus.Error("PQExec failed: " + err.Error())
+		L.Push(lua.LNumber(0))
+		L.Push(lua.LNumber(0))
+		return 2 // number of results
+	}
+	L.Push(lua.LNumber(rowsAffected))
+	L.Push(lua.LNumber(lastInsertID))
+	return 2 // number of results
 }
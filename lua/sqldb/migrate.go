@@ -0,0 +1,205 @@
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// migrationFilePattern matches versioned migration files, eg. 0001_create_users.up.sql
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// MigrationStep holds the up and down SQL scripts for a single schema version.
+type MigrationStep struct {
+	Version int
+	Name    string
+	UpSQL   string
+	DownSQL string
+}
+
+// LoadMigrations reads and pairs up the .sql files in dir, sorted by version.
+func LoadMigrations(dir string) ([]MigrationStep, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read migrations directory %s: %w", dir, err)
+	}
+	steps := make(map[int]*MigrationStep)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		m := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+		version, err := strconv.Atoi(m[1])
+		if err != nil {
+			continue
+		}
+		step, ok := steps[version]
+		if !ok {
+			step = &MigrationStep{Version: version, Name: m[2]}
+			steps[version] = step
+		}
+		contents, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read migration file %s: %w", entry.Name(), err)
+		}
+		if m[3] == "up" {
+			step.UpSQL = string(contents)
+		} else {
+			step.DownSQL = string(contents)
+		}
+	}
+	ordered := make([]MigrationStep, 0, len(steps))
+	for _, step := range steps {
+		ordered = append(ordered, *step)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].Version < ordered[j].Version })
+	return ordered, nil
+}
+
+// MigrationDialect supplies the driver-specific SQL needed to track applied
+// migrations in a schema_migrations table, so that Migrate itself stays
+// dialect-agnostic.
+type MigrationDialect struct {
+	// CreateTrackerTable creates the schema_migrations table if it doesn't already exist.
+	CreateTrackerTable string
+	// SelectState returns the latest tracked version and dirty flag.
+	SelectState string
+	// DeleteState clears every row from the tracker table.
+	DeleteState string
+	// InsertState inserts a (version, dirty) row, using the driver's own placeholder style.
+	InsertState string
+}
+
+func ensureMigrationsTable(db *sql.DB, dialect MigrationDialect) error {
+	_, err := db.Exec(dialect.CreateTrackerTable)
+	return err
+}
+
+func migrationState(db *sql.DB, dialect MigrationDialect) (version int, dirty bool, err error) {
+	row := db.QueryRow(dialect.SelectState)
+	err = row.Scan(&version, &dirty)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
+
+func setMigrationState(db *sql.DB, dialect MigrationDialect, version int, dirty bool) error {
+	if _, err := db.Exec(dialect.DeleteState); err != nil {
+		return err
+	}
+	_, err := db.Exec(dialect.InsertState, version, dirty)
+	return err
+}
+
+// runMigrationStep applies a single migration step, in the given direction,
+// inside a transaction, marking the tracker table dirty for the duration of
+// the run. prevVersion is only used on "down": it's the version to record
+// afterwards, namely the step below this one in the ordered list (or 0 if
+// this is the first step), since version numbers need not be contiguous
+// and step.Version-1 may not name an actual migration.
+func runMigrationStep(db *sql.DB, dialect MigrationDialect, step MigrationStep, direction string, prevVersion int) error {
+	script := step.UpSQL
+	newVersion := step.Version
+	if direction == "down" {
+		script = step.DownSQL
+		newVersion = prevVersion
+	}
+	if script == "" {
+		return fmt.Errorf("migration %d (%s) has no %s script", step.Version, step.Name, direction)
+	}
+	if err := setMigrationState(db, dialect, step.Version, true); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(script); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migration %d (%s) failed: %w", step.Version, step.Name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return setMigrationState(db, dialect, newVersion, false)
+}
+
+// Migrate runs the given migrate command ("up", "down", "goto" or "force")
+// against db, using the versioned .sql files found in dir and the tracker
+// table described by dialect. target is only used by "goto" and "force".
+func Migrate(db *sql.DB, dialect MigrationDialect, dir, command string, target int) error {
+	if err := ensureMigrationsTable(db, dialect); err != nil {
+		return err
+	}
+	steps, err := LoadMigrations(dir)
+	if err != nil {
+		return err
+	}
+	version, dirty, err := migrationState(db, dialect)
+	if err != nil {
+		return err
+	}
+	if dirty && command != "force" {
+		return fmt.Errorf("schema is dirty at version %d, run force(%d) before migrating further", version, version)
+	}
+	switch command {
+	case "force":
+		return setMigrationState(db, dialect, target, false)
+	case "up":
+		for _, step := range steps {
+			if step.Version <= version {
+				continue
+			}
+			if err := runMigrationStep(db, dialect, step, "up", 0); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "down":
+		for i := len(steps) - 1; i >= 0; i-- {
+			if steps[i].Version == version {
+				prevVersion := 0
+				if i > 0 {
+					prevVersion = steps[i-1].Version
+				}
+				return runMigrationStep(db, dialect, steps[i], "down", prevVersion)
+			}
+		}
+		return nil
+	case "goto":
+		if target >= version {
+			for _, step := range steps {
+				if step.Version <= version || step.Version > target {
+					continue
+				}
+				if err := runMigrationStep(db, dialect, step, "up", 0); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		for i := len(steps) - 1; i >= 0; i-- {
+			if steps[i].Version <= target || steps[i].Version > version {
+				continue
+			}
+			prevVersion := 0
+			if i > 0 {
+				prevVersion = steps[i-1].Version
+			}
+			if err := runMigrationStep(db, dialect, steps[i], "down", prevVersion); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command: %s", command)
+	}
+}
@@ -0,0 +1,512 @@
+// Package sqldb provides a generic database/sql Lua binding that is shared by
+// the driver-specific packages (mssql, pquery), plus a lower-level sql.open
+// API for scripts that want direct access to prepared statements and
+// transactions.
+package sqldb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/convert"
+	lua "github.com/xyproto/gopher-lua"
+
+	// The database engines made available through SQL() and sql.open()
+	_ "github.com/denisenkom/go-mssqldb"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Lua userdata class names
+const (
+	HandleClass = "SQLHandle"
+	StmtClass   = "SQLStmt"
+	TxClass     = "SQLTx"
+)
+
+// driverNames maps the short driver names accepted from Lua to the database/sql driver name.
+var driverNames = map[string]string{
+	"postgres":   "postgres",
+	"postgresql": "postgres",
+	"pq":         "postgres",
+	"mssql":      "sqlserver",
+	"sqlserver":  "sqlserver",
+	"mysql":      "mysql",
+	"sqlite":     "sqlite3",
+	"sqlite3":    "sqlite3",
+}
+
+// resolveDriver returns the database/sql driver name for the given short name from Lua.
+func resolveDriver(name string) (string, error) {
+	driverName, ok := driverNames[strings.ToLower(name)]
+	if !ok {
+		return "", fmt.Errorf("unknown SQL driver: %s", name)
+	}
+	return driverName, nil
+}
+
+var (
+	// global map from driver+connection string to database connection, to reuse connections, protected by a mutex
+	reuseDB  = make(map[string]*sql.DB)
+	reuseMut = &sync.RWMutex{}
+)
+
+// GetConnection returns a cached *sql.DB for the given driver/connection string
+// pair, opening a new one (and caching it) if none exists yet or the cached
+// one has gone stale.
+func GetConnection(driverName, connectionString string) (*sql.DB, error) {
+	key := driverName + "\x00" + connectionString
+	reuseMut.RLock()
+	conn, ok := reuseDB[key]
+	reuseMut.RUnlock()
+
+	if ok {
+		// It exists, but is it still alive?
+		if err := conn.Ping(); err != nil {
+			// no
+			reuseMut.Lock()
+			delete(reuseDB, key)
+			reuseMut.Unlock()
+		} else {
+			// yes
+			return conn, nil
+		}
+	}
+	// Create a new connection
+	db, err := sql.Open(driverName, connectionString)
+	if err != nil {
+		return nil, err
+	}
+	// Save the connection for later
+	reuseMut.Lock()
+	reuseDB[key] = db
+	reuseMut.Unlock()
+	return db, nil
+}
+
+// ArgsFromTable turns a Lua table argument into positional/named query
+// parameters: numeric keys become positional args and string keys become
+// named parameters.
+func ArgsFromTable(L *lua.LState, index int) []any {
+	var queryArgs []any
+	if L.GetTop() < index {
+		return queryArgs
+	}
+	args := L.ToTable(index)
+	if args == nil {
+		return queryArgs
+	}
+	args.ForEach(func(k, v lua.LValue) {
+		switch k.Type() {
+		case lua.LTNumber:
+			queryArgs = append(queryArgs, v.String())
+		case lua.LTString:
+			queryArgs = append(queryArgs, sql.Named(k.String(), v.String()))
+		}
+	})
+	return queryArgs
+}
+
+// RowsToTable scans the given *sql.Rows into a 2-dimensional Lua table: the
+// outer table is an array of rows and each inner table maps column names to
+// typed values.
+func RowsToTable(L *lua.LState, rows *sql.Rows) (*lua.LTable, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var maps []map[string]lua.LValue
+	for rows.Next() {
+		values := make(LValueWrappers, len(cols))
+		if err := rows.Scan(values.Interfaces()...); err != nil {
+			return nil, err
+		}
+		m := make(map[string]lua.LValue, len(cols))
+		for i, v := range values.Unwrap() {
+			m[cols[i]] = v
+		}
+		maps = append(maps, m)
+	}
+	return convert.LValueMaps2table(L, maps), nil
+}
+
+// isSelect reports whether query looks like a row-returning statement, as
+// opposed to one that should be run with Exec.
+func isSelect(query string) bool {
+	trimmed := strings.ToUpper(strings.TrimSpace(query))
+	return strings.HasPrefix(trimmed, "SELECT") || strings.HasPrefix(trimmed, "WITH") || strings.HasPrefix(trimmed, "SHOW")
+}
+
+// QueryCached runs a row-returning query against db using a prepared
+// statement from the shared cache (see prepareCached), keyed by connKey, and
+// returns the result as a Lua table. It is the shared implementation behind
+// SQL(), sql.open() handles and the driver-specific globals (MSSQL, PQ);
+// transactions bind the same cached statements with tx.Stmt instead.
+func QueryCached(L *lua.LState, db *sql.DB, connKey, query string, queryArgs []any) (*lua.LTable, error) {
+	stmt, err := prepareCached(db, connKey, query)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := stmt.Query(queryArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return RowsToTable(L, rows)
+}
+
+// ExecCached runs a non-row-returning statement against db using a prepared
+// statement from the shared cache (see prepareCached), keyed by connKey, and
+// returns rows_affected and last_insert_id. It is the shared implementation
+// behind SQL(), sql.open() handles and PQExec; transactions bind the same
+// cached statements with tx.Stmt instead.
+func ExecCached(db *sql.DB, connKey, query string, queryArgs []any) (rowsAffected, lastInsertID int64, err error) {
+	stmt, err := prepareCached(db, connKey, query)
+	if err != nil {
+		return 0, 0, err
+	}
+	result, err := stmt.Exec(queryArgs...)
+	if err != nil {
+		return 0, 0, err
+	}
+	rowsAffected, _ = result.RowsAffected()
+	lastInsertID, _ = result.LastInsertId()
+	return rowsAffected, lastInsertID, nil
+}
+
+// sqlQuery implements the SQL(driver, query, connString, args) Lua global.
+// Row-returning queries return a table of rows, other statements return
+// rows_affected and last_insert_id.
+func sqlQuery(L *lua.LState) int {
+	driverName, err := resolveDriver(L.ToString(1))
+	if err != nil {
+		logrus.Error(err.Error())
+		L.Push(L.NewTable())
+		return 1 // number of results
+	}
+	query := L.ToString(2)
+	connectionString := L.ToString(3)
+	queryArgs := ArgsFromTable(L, 4)
+
+	db, err := GetConnection(driverName, connectionString)
+	if err != nil {
+		logrus.Error("Could not connect to database using " + connectionString + ": " + err.Error())
+		L.Push(L.NewTable())
+		return 1 // number of results
+	}
+	connKey := driverName + "\x00" + connectionString
+
+	if isSelect(query) {
+		table, err := QueryCached(L, db, connKey, query, queryArgs)
+		if err != nil {
+			logrus.Error("Query failed: " + err.Error())
+			L.Push(L.NewTable())
+			return 1 // number of results
+		}
+		L.Push(table)
+		return 1 // number of results
+	}
+
+	rowsAffected, lastInsertID, err := ExecCached(db, connKey, query, queryArgs)
+	if err != nil {
+		logrus.Error("Exec failed: " + err.Error())
+		L.Push(lua.LNumber(0))
+		L.Push(lua.LNumber(0))
+		return 2 // number of results
+	}
+	L.Push(lua.LNumber(rowsAffected))
+	L.Push(lua.LNumber(lastInsertID))
+	return 2 // number of results
+}
+
+// dbHandle is the userdata value behind a sql.open() handle in Lua.
+type dbHandle struct {
+	db               *sql.DB
+	driverName       string
+	connectionString string
+}
+
+func checkHandle(L *lua.LState) *dbHandle {
+	ud := L.CheckUserData(1)
+	if h, ok := ud.Value.(*dbHandle); ok {
+		return h
+	}
+	L.ArgError(1, "sql handle expected")
+	return nil
+}
+
+// sqlOpen implements the sql.open(driver, connString) Lua function.
+func sqlOpen(L *lua.LState) int {
+	driverName, err := resolveDriver(L.ToString(1))
+	if err != nil {
+		logrus.Error(err.Error())
+		L.Push(lua.LNil)
+		return 1 // number of results
+	}
+	connectionString := L.ToString(2)
+	db, err := GetConnection(driverName, connectionString)
+	if err != nil {
+		logrus.Error("Could not connect to database using " + connectionString + ": " + err.Error())
+		L.Push(lua.LNil)
+		return 1 // number of results
+	}
+	ud := L.NewUserData()
+	ud.Value = &dbHandle{db: db, driverName: driverName, connectionString: connectionString}
+	L.SetMetatable(ud, L.GetTypeMetatable(HandleClass))
+	L.Push(ud)
+	return 1 // number of results
+}
+
+func handleQuery(L *lua.LState) int {
+	h := checkHandle(L)
+	table, err := QueryCached(L, h.db, h.driverName+"\x00"+h.connectionString, L.ToString(2), ArgsFromTable(L, 3))
+	if err != nil {
+		logrus.Error("Query failed: " + err.Error())
+		L.Push(L.NewTable())
+		return 1 // number of results
+	}
+	L.Push(table)
+	return 1 // number of results
+}
+
+func handleExec(L *lua.LState) int {
+	h := checkHandle(L)
+	rowsAffected, lastInsertID, err := ExecCached(h.db, h.driverName+"\x00"+h.connectionString, L.ToString(2), ArgsFromTable(L, 3))
+	if err != nil {
+		logrus.Error("Exec failed: " + err.Error())
+		L.Push(lua.LNumber(0))
+		L.Push(lua.LNumber(0))
+		return 2 // number of results
+	}
+	L.Push(lua.LNumber(rowsAffected))
+	L.Push(lua.LNumber(lastInsertID))
+	return 2 // number of results
+}
+
+func handlePrepare(L *lua.LState) int {
+	h := checkHandle(L)
+	stmt, err := prepareCached(h.db, h.driverName+"\x00"+h.connectionString, L.ToString(2))
+	if err != nil {
+		logrus.Error("Prepare failed: " + err.Error())
+		L.Push(lua.LNil)
+		return 1 // number of results
+	}
+	ud := L.NewUserData()
+	ud.Value = stmt
+	L.SetMetatable(ud, L.GetTypeMetatable(StmtClass))
+	L.Push(ud)
+	return 1 // number of results
+}
+
+func handleBegin(L *lua.LState) int {
+	h := checkHandle(L)
+	tx, err := h.db.Begin()
+	if err != nil {
+		logrus.Error("Begin failed: " + err.Error())
+		L.Push(lua.LNil)
+		return 1 // number of results
+	}
+	ud := L.NewUserData()
+	ud.Value = &txHandle{tx: tx, db: h.db, connKey: h.driverName + "\x00" + h.connectionString}
+	L.SetMetatable(ud, L.GetTypeMetatable(TxClass))
+	L.Push(ud)
+	return 1 // number of results
+}
+
+func handleSetMaxOpenConns(L *lua.LState) int {
+	h := checkHandle(L)
+	h.db.SetMaxOpenConns(L.ToInt(2))
+	return 0 // number of results
+}
+
+func handleSetMaxIdleConns(L *lua.LState) int {
+	h := checkHandle(L)
+	h.db.SetMaxIdleConns(L.ToInt(2))
+	return 0 // number of results
+}
+
+func handleSetConnMaxLifetime(L *lua.LState) int {
+	h := checkHandle(L)
+	h.db.SetConnMaxLifetime(time.Duration(L.ToInt64(2)) * time.Second)
+	return 0 // number of results
+}
+
+func checkStmt(L *lua.LState) *sql.Stmt {
+	ud := L.CheckUserData(1)
+	if stmt, ok := ud.Value.(*sql.Stmt); ok {
+		return stmt
+	}
+	L.ArgError(1, "sql statement expected")
+	return nil
+}
+
+func stmtQuery(L *lua.LState) int {
+	stmt := checkStmt(L)
+	rows, err := stmt.Query(ArgsFromTable(L, 2)...)
+	if err != nil {
+		logrus.Error("Query failed: " + err.Error())
+		L.Push(L.NewTable())
+		return 1 // number of results
+	}
+	defer rows.Close()
+	table, err := RowsToTable(L, rows)
+	if err != nil {
+		logrus.Error("Failed to scan rows: " + err.Error())
+		L.Push(L.NewTable())
+		return 1 // number of results
+	}
+	L.Push(table)
+	return 1 // number of results
+}
+
+func stmtExec(L *lua.LState) int {
+	stmt := checkStmt(L)
+	result, err := stmt.Exec(ArgsFromTable(L, 2)...)
+	if err != nil {
+		logrus.Error("Exec failed: " + err.Error())
+		L.Push(lua.LNumber(0))
+		L.Push(lua.LNumber(0))
+		return 2 // number of results
+	}
+	rowsAffected, _ := result.RowsAffected()
+	lastInsertID, _ := result.LastInsertId()
+	L.Push(lua.LNumber(rowsAffected))
+	L.Push(lua.LNumber(lastInsertID))
+	return 2 // number of results
+}
+
+// txHandle is the userdata value behind a handle:begin() transaction in Lua.
+// It keeps the underlying *sql.DB and cache key alongside the *sql.Tx so that
+// txQuery/txExec can look up a cached prepared statement and bind it to the
+// transaction with tx.Stmt, the same as every other query path in this file.
+type txHandle struct {
+	tx      *sql.Tx
+	db      *sql.DB
+	connKey string
+}
+
+func checkTx(L *lua.LState) *txHandle {
+	ud := L.CheckUserData(1)
+	if th, ok := ud.Value.(*txHandle); ok {
+		return th
+	}
+	L.ArgError(1, "sql transaction expected")
+	return nil
+}
+
+func txQuery(L *lua.LState) int {
+	th := checkTx(L)
+	stmt, err := prepareCached(th.db, th.connKey, L.ToString(2))
+	if err != nil {
+		logrus.Error("Prepare failed: " + err.Error())
+		L.Push(L.NewTable())
+		return 1 // number of results
+	}
+	rows, err := th.tx.Stmt(stmt).Query(ArgsFromTable(L, 3)...)
+	if err != nil {
+		logrus.Error("Query failed: " + err.Error())
+		L.Push(L.NewTable())
+		return 1 // number of results
+	}
+	defer rows.Close()
+	table, err := RowsToTable(L, rows)
+	if err != nil {
+		logrus.Error("Failed to scan rows: " + err.Error())
+		L.Push(L.NewTable())
+		return 1 // number of results
+	}
+	L.Push(table)
+	return 1 // number of results
+}
+
+func txExec(L *lua.LState) int {
+	th := checkTx(L)
+	stmt, err := prepareCached(th.db, th.connKey, L.ToString(2))
+	if err != nil {
+		logrus.Error("Prepare failed: " + err.Error())
+		L.Push(lua.LNumber(0))
+		L.Push(lua.LNumber(0))
+		return 2 // number of results
+	}
+	result, err := th.tx.Stmt(stmt).Exec(ArgsFromTable(L, 3)...)
+	if err != nil {
+		logrus.Error("Exec failed: " + err.Error())
+		L.Push(lua.LNumber(0))
+		L.Push(lua.LNumber(0))
+		return 2 // number of results
+	}
+	rowsAffected, _ := result.RowsAffected()
+	lastInsertID, _ := result.LastInsertId()
+	L.Push(lua.LNumber(rowsAffected))
+	L.Push(lua.LNumber(lastInsertID))
+	return 2 // number of results
+}
+
+func txCommit(L *lua.LState) int {
+	th := checkTx(L)
+	if err := th.tx.Commit(); err != nil {
+		logrus.Error("Commit failed: " + err.Error())
+		L.Push(lua.LString(err.Error()))
+		return 1 // number of results
+	}
+	return 0 // number of results
+}
+
+func txRollback(L *lua.LState) int {
+	th := checkTx(L)
+	if err := th.tx.Rollback(); err != nil {
+		logrus.Error("Rollback failed: " + err.Error())
+		L.Push(lua.LString(err.Error()))
+		return 1 // number of results
+	}
+	return 0 // number of results
+}
+
+// The hash map methods that are to be registered for each userdata class
+var (
+	handleMethods = map[string]lua.LGFunction{
+		"query":              handleQuery,
+		"exec":               handleExec,
+		"prepare":            handlePrepare,
+		"begin":              handleBegin,
+		"SetMaxOpenConns":    handleSetMaxOpenConns,
+		"SetMaxIdleConns":    handleSetMaxIdleConns,
+		"SetConnMaxLifetime": handleSetConnMaxLifetime,
+	}
+	stmtMethods = map[string]lua.LGFunction{
+		"query": stmtQuery,
+		"exec":  stmtExec,
+	}
+	txMethods = map[string]lua.LGFunction{
+		"query":    txQuery,
+		"exec":     txExec,
+		"commit":   txCommit,
+		"rollback": txRollback,
+	}
+)
+
+// Load makes functions related to building a library of Lua code available
+func Load(L *lua.LState) {
+	for class, methods := range map[string]map[string]lua.LGFunction{
+		HandleClass: handleMethods,
+		StmtClass:   stmtMethods,
+		TxClass:     txMethods,
+	} {
+		mt := L.NewTypeMetatable(class)
+		mt.RawSetH(lua.LString("__index"), mt)
+		L.SetFuncs(mt, methods)
+	}
+
+	// Register the generic SQL(driver, query, connString, args) function
+	L.SetGlobal("SQL", L.NewFunction(sqlQuery))
+
+	// Register the sql table, with sql.open(driver, connString)
+	sqlTable := L.NewTable()
+	L.SetField(sqlTable, "open", L.NewFunction(sqlOpen))
+	L.SetGlobal("sql", sqlTable)
+}
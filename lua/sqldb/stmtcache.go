@@ -0,0 +1,86 @@
+package sqldb
+
+import (
+	"container/list"
+	"database/sql"
+	"sync"
+)
+
+// defaultStmtCacheSize is how many prepared statements are kept warm, per process.
+const defaultStmtCacheSize = 128
+
+// stmtCacheEntry is the value stored in the LRU cache's linked list.
+type stmtCacheEntry struct {
+	key  string
+	stmt *sql.Stmt
+}
+
+// stmtCache is a size-bounded LRU cache of prepared statements, keyed by
+// (connection, query), so that repeated queries reuse the same *sql.Stmt.
+type stmtCache struct {
+	mut      sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newStmtCache(capacity int) *stmtCache {
+	return &stmtCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// get returns a prepared statement for connKey+query, preparing and caching a
+// new one if it isn't already cached. The least recently used statement is
+// evicted and closed once the cache grows past its capacity.
+func (c *stmtCache) get(db *sql.DB, connKey, query string) (*sql.Stmt, error) {
+	key := connKey + "\x00" + query
+
+	c.mut.Lock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		stmt := el.Value.(*stmtCacheEntry).stmt
+		c.mut.Unlock()
+		return stmt, nil
+	}
+	c.mut.Unlock()
+
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	// Another goroutine may have prepared the same statement while we didn't hold the lock
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		stmt.Close()
+		return el.Value.(*stmtCacheEntry).stmt, nil
+	}
+	el := c.ll.PushFront(&stmtCacheEntry{key: key, stmt: stmt})
+	c.items[key] = el
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			entry := oldest.Value.(*stmtCacheEntry)
+			delete(c.items, entry.key)
+			entry.stmt.Close()
+		}
+	}
+	return stmt, nil
+}
+
+// globalStmtCache is shared by SQL(), every sql.open() handle and the
+// transactions started from one, so repeated queries against the same
+// connection reuse a single prepared statement regardless of which of
+// those entry points issues them.
+var globalStmtCache = newStmtCache(defaultStmtCacheSize)
+
+// prepareCached returns a cached prepared statement for connKey+query.
+func prepareCached(db *sql.DB, connKey, query string) (*sql.Stmt, error) {
+	return globalStmtCache.get(db, connKey, query)
+}
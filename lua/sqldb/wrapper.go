@@ -0,0 +1,74 @@
+package sqldb
+
+import (
+	"fmt"
+	"time"
+
+	lua "github.com/xyproto/gopher-lua"
+)
+
+// LValueWrapper decorates lua.LValue to help retrieve values from the database.
+type LValueWrapper struct {
+	LValue lua.LValue
+}
+
+// Scan implements the sql.Scanner interface for database deserialization.
+func (w *LValueWrapper) Scan(value any) error {
+	if value == nil {
+		*w = LValueWrapper{lua.LNil}
+		return nil
+	}
+
+	switch v := value.(type) {
+
+	case float32:
+		*w = LValueWrapper{lua.LNumber(float64(v))}
+
+	case float64:
+		*w = LValueWrapper{lua.LNumber(v)}
+
+	case int64:
+		*w = LValueWrapper{lua.LNumber(float64(v))}
+
+	case string:
+		*w = LValueWrapper{lua.LString(v)}
+
+	case []byte:
+		*w = LValueWrapper{lua.LString(string(v))}
+
+	case time.Time:
+		*w = LValueWrapper{lua.LNumber(float64(v.Unix()))}
+
+	case bool:
+		*w = LValueWrapper{lua.LBool(v)}
+
+	default:
+		// Degrade to a string instead of failing the whole row set over a
+		// driver-specific type (eg. a driver's own named numeric type).
+		*w = LValueWrapper{lua.LString(fmt.Sprintf("%v", v))}
+
+	}
+
+	return nil
+}
+
+// LValueWrappers is a convenience type to easily map to a slice of lua.LValue
+type LValueWrappers []LValueWrapper
+
+// Unwrap produces a slice of lua.LValue from the given LValueWrappers
+func (w LValueWrappers) Unwrap() (s []lua.LValue) {
+	s = make([]lua.LValue, len(w))
+	for i, v := range w {
+		s[i] = v.LValue
+	}
+	return
+}
+
+// Interfaces returns a slice of any values from the given LValueWrappers
+func (w LValueWrappers) Interfaces() (s []any) {
+	s = make([]any, len(w))
+	for i := range w {
+		s[i] = &w[i]
+	}
+	return
+}
@@ -0,0 +1,362 @@
+// Package vectorstore provides a Lua-exposed similarity search index, backed
+// by Postgres/pgvector, over text embedded with the Ollama Lua API.
+package vectorstore
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"github.com/xyproto/algernon/lua/convert"
+	"github.com/xyproto/algernon/lua/ollama"
+	"github.com/xyproto/algernon/lua/sqldb"
+	lua "github.com/xyproto/gopher-lua"
+	"github.com/xyproto/ollamaclient/v2"
+)
+
+const (
+	// Class is an identifier for the VectorStore class in Lua
+	Class = "VectorStore"
+
+	defaultTable = "algernon_vectorstore"
+)
+
+// Store is a similarity search index over (id, text, metadata, embedding) rows,
+// backed by a Postgres table when the pgvector extension is available, and an
+// in-memory cosine index otherwise.
+type Store struct {
+	db    *sql.DB
+	table string
+	oc    *ollamaclient.Config
+
+	useVector bool // whether the pgvector extension could be enabled
+
+	mut sync.RWMutex
+	dim int // embedding width, learned from the first upsert
+	mem map[string]memEntry
+}
+
+// memEntry is a single row in the in-memory fallback index.
+type memEntry struct {
+	text     string
+	metadata string
+	vector   []float64
+}
+
+// checkStore retrieves the Store from the first (self) argument.
+func checkStore(L *lua.LState) *Store {
+	ud := L.CheckUserData(1)
+	if vs, ok := ud.Value.(*Store); ok {
+		return vs
+	}
+	L.ArgError(1, "VectorStore expected")
+	return nil
+}
+
+// vectorLiteral formats a []float64 as a pgvector input literal, eg. "[0.1,0.2,0.3]".
+func vectorLiteral(embedding []float64) string {
+	parts := make([]string, len(embedding))
+	for i, f := range embedding {
+		parts[i] = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+// ensureTable creates the backing table, with an embedding column sized to
+// dim, the first time any embedding is stored; later calls do nothing,
+// whatever their width.
+func (vs *Store) ensureTable(dim int) error {
+	vs.mut.Lock()
+	defer vs.mut.Unlock()
+	if vs.dim != 0 {
+		return nil
+	}
+	if vs.useVector {
+		query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id TEXT PRIMARY KEY, content TEXT, metadata TEXT, embedding vector(%d))`, pq.QuoteIdentifier(vs.table), dim)
+		if _, err := vs.db.Exec(query); err != nil {
+			return err
+		}
+	}
+	vs.dim = dim
+	return nil
+}
+
+// upsertPG inserts or updates a row in the Postgres-backed table.
+func (vs *Store) upsertPG(id, text, metadata string, embedding []float64) error {
+	query := fmt.Sprintf(`INSERT INTO %s (id, content, metadata, embedding) VALUES ($1, $2, $3, $4::vector)
+		ON CONFLICT (id) DO UPDATE SET content = EXCLUDED.content, metadata = EXCLUDED.metadata, embedding = EXCLUDED.embedding`, pq.QuoteIdentifier(vs.table))
+	_, err := vs.db.Exec(query, id, text, metadata, vectorLiteral(embedding))
+	return err
+}
+
+// searchPG runs a nearest-neighbour query using pgvector's distance operator.
+func (vs *Store) searchPG(L *lua.LState, embedding []float64, k int) (*lua.LTable, error) {
+	query := fmt.Sprintf(`SELECT id, content, metadata, embedding <-> $1::vector AS distance FROM %s ORDER BY embedding <-> $1::vector LIMIT $2`, pq.QuoteIdentifier(vs.table))
+	rows, err := vs.db.Query(query, vectorLiteral(embedding), k)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return sqldb.RowsToTable(L, rows)
+}
+
+// upsertMemory inserts or updates a row in the in-memory fallback index.
+func (vs *Store) upsertMemory(id, text, metadata string, embedding []float64) {
+	vs.mut.Lock()
+	defer vs.mut.Unlock()
+	vs.mem[id] = memEntry{text: text, metadata: metadata, vector: embedding}
+}
+
+// memResult is a single scored match from the in-memory fallback index.
+type memResult struct {
+	id       string
+	entry    memEntry
+	distance float64
+}
+
+// searchMemory finds the k nearest rows in the in-memory fallback index, by cosine distance.
+func (vs *Store) searchMemory(embedding []float64, k int) []memResult {
+	vs.mut.RLock()
+	defer vs.mut.RUnlock()
+	results := make([]memResult, 0, len(vs.mem))
+	for id, entry := range vs.mem {
+		d, err := ollama.CosineDistance(embedding, entry.vector)
+		if err != nil {
+			continue
+		}
+		results = append(results, memResult{id: id, entry: entry, distance: d})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].distance < results[j].distance })
+	if k >= 0 && k < len(results) {
+		results = results[:k]
+	}
+	return results
+}
+
+// storeUpsert embeds text and stores it under id, along with its metadata.
+func storeUpsert(L *lua.LState) int {
+	vs := checkStore(L) // arg 1
+	id := L.ToString(2)
+	text := L.ToString(3)
+	metadata := ""
+	if L.GetTop() >= 4 {
+		metadata = L.ToString(4)
+	}
+	embedding, err := vs.oc.Embeddings(text)
+	if err != nil {
+		log.Error(err)
+		L.Push(lua.LString(err.Error()))
+		return 1 // number of results
+	}
+	if err := vs.ensureTable(len(embedding)); err != nil {
+		log.Error(err)
+		L.Push(lua.LString(err.Error()))
+		return 1 // number of results
+	}
+	if vs.useVector {
+		err = vs.upsertPG(id, text, metadata, embedding)
+	} else {
+		vs.upsertMemory(id, text, metadata, embedding)
+	}
+	if err != nil {
+		log.Error(err)
+		L.Push(lua.LString(err.Error()))
+		return 1 // number of results
+	}
+	return 0 // number of results
+}
+
+// storeSearch embeds text and returns the k closest matches, each as a table
+// with id, content, metadata and distance fields, plus a trailing error
+// string that is empty on success. Unlike storeUpsert/storeDelete (which
+// push nothing but the error string on failure), storeSearch always returns
+// both values, since the first is meaningful even when empty.
+func storeSearch(L *lua.LState) int {
+	vs := checkStore(L) // arg 1
+	text := L.ToString(2)
+	k := 5
+	if L.GetTop() >= 3 {
+		k = L.ToInt(3)
+	}
+	embedding, err := vs.oc.Embeddings(text)
+	if err != nil {
+		log.Error(err)
+		L.Push(L.NewTable())
+		L.Push(lua.LString(err.Error()))
+		return 2 // number of results
+	}
+	if vs.useVector {
+		table, err := vs.searchPG(L, embedding, k)
+		if err != nil {
+			log.Error(err)
+			L.Push(L.NewTable())
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(table)
+		L.Push(lua.LString(""))
+		return 2 // number of results
+	}
+	results := vs.searchMemory(embedding, k)
+	maps := make([]map[string]lua.LValue, len(results))
+	for i, r := range results {
+		maps[i] = map[string]lua.LValue{
+			"id":       lua.LString(r.id),
+			"content":  lua.LString(r.entry.text),
+			"metadata": lua.LString(r.entry.metadata),
+			"distance": lua.LNumber(r.distance),
+		}
+	}
+	L.Push(convert.LValueMaps2table(L, maps))
+	L.Push(lua.LString(""))
+	return 2 // number of results
+}
+
+// storeDelete removes the row with the given id, if it exists.
+func storeDelete(L *lua.LState) int {
+	vs := checkStore(L) // arg 1
+	id := L.ToString(2)
+	if vs.useVector {
+		query := fmt.Sprintf(`DELETE FROM %s WHERE id = $1`, pq.QuoteIdentifier(vs.table))
+		if _, err := vs.db.Exec(query, id); err != nil {
+			log.Error(err)
+			L.Push(lua.LString(err.Error()))
+			return 1 // number of results
+		}
+		return 0 // number of results
+	}
+	vs.mut.Lock()
+	delete(vs.mem, id)
+	vs.mut.Unlock()
+	return 0 // number of results
+}
+
+// storeCount returns the number of rows currently stored, plus a trailing
+// error string that is empty on success. Unlike storeUpsert/storeDelete
+// (which push nothing but the error string on failure), storeCount always
+// returns both values, since the first is meaningful even when zero.
+func storeCount(L *lua.LState) int {
+	vs := checkStore(L) // arg 1
+	if vs.useVector {
+		var n int64
+		query := fmt.Sprintf(`SELECT COUNT(*) FROM %s`, pq.QuoteIdentifier(vs.table))
+		if err := vs.db.QueryRow(query).Scan(&n); err != nil {
+			// The table has not been created yet (undefined_table), so it holds no rows
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "42P01" {
+				L.Push(lua.LNumber(0))
+				L.Push(lua.LString(""))
+				return 2 // number of results
+			}
+			log.Error(err)
+			L.Push(lua.LNumber(0))
+			L.Push(lua.LString(err.Error()))
+			return 2 // number of results
+		}
+		L.Push(lua.LNumber(n))
+		L.Push(lua.LString(""))
+		return 2 // number of results
+	}
+	vs.mut.RLock()
+	n := len(vs.mem)
+	vs.mut.RUnlock()
+	L.Push(lua.LNumber(n))
+	L.Push(lua.LString(""))
+	return 2 // number of results
+}
+
+// storeReindex rebuilds the IVFFLAT index over the embedding column. It is a
+// no-op when running against the in-memory fallback.
+func storeReindex(L *lua.LState) int {
+	vs := checkStore(L) // arg 1
+	vs.mut.RLock()
+	dim := vs.dim
+	vs.mut.RUnlock()
+	if !vs.useVector || dim == 0 {
+		return 0 // number of results
+	}
+	indexName := vs.table + "_embedding_ivfflat_idx"
+	if _, err := vs.db.Exec(fmt.Sprintf(`DROP INDEX IF EXISTS %s`, pq.QuoteIdentifier(indexName))); err != nil {
+		log.Error(err)
+		L.Push(lua.LString(err.Error()))
+		return 1 // number of results
+	}
+	query := fmt.Sprintf(`CREATE INDEX %s ON %s USING ivfflat (embedding vector_l2_ops) WITH (lists = 100)`, pq.QuoteIdentifier(indexName), pq.QuoteIdentifier(vs.table))
+	if _, err := vs.db.Exec(query); err != nil {
+		log.Error(err)
+		L.Push(lua.LString(err.Error()))
+		return 1 // number of results
+	}
+	return 0 // number of results
+}
+
+// The hash map methods that are to be registered
+var storeMethods = map[string]lua.LGFunction{
+	"upsert":  storeUpsert,
+	"search":  storeSearch,
+	"delete":  storeDelete,
+	"count":   storeCount,
+	"reindex": storeReindex,
+}
+
+// constructStore builds a new Store from the given connection string and table name.
+// An existing OllamaClient userdata may be passed as a third argument, to reuse a
+// model that was already pulled; otherwise a client with the default model is created.
+func constructStore(L *lua.LState) (*lua.LUserData, error) {
+	connectionString := L.ToString(1)
+	table := defaultTable
+	if L.GetTop() >= 2 && L.ToString(2) != "" {
+		table = L.ToString(2)
+	}
+	oc := ollamaclient.New()
+	if L.GetTop() >= 3 {
+		ud := L.CheckUserData(3)
+		if existing, ok := ud.Value.(*ollamaclient.Config); ok {
+			oc = existing
+		}
+	}
+	db, err := sqldb.GetConnection("postgres", connectionString)
+	if err != nil {
+		return nil, err
+	}
+	useVector := true
+	if _, err := db.Exec(`CREATE EXTENSION IF NOT EXISTS vector`); err != nil {
+		log.Info("pgvector extension unavailable, falling back to an in-memory index: " + err.Error())
+		useVector = false
+	}
+	vs := &Store{
+		db:        db,
+		table:     table,
+		oc:        oc,
+		useVector: useVector,
+		mem:       make(map[string]memEntry),
+	}
+	ud := L.NewUserData()
+	ud.Value = vs
+	L.SetMetatable(ud, L.GetTypeMetatable(Class))
+	return ud, nil
+}
+
+// Load makes the VectorStore class and constructor available to the given Lua state.
+func Load(L *lua.LState) {
+	// Register the VectorStore class and the methods that belong with it.
+	mt := L.NewTypeMetatable(Class)
+	mt.RawSetH(lua.LString("__index"), mt)
+	L.SetFuncs(mt, storeMethods)
+
+	// The constructor takes a connection string, a table name and an optional OllamaClient
+	L.SetGlobal("VectorStore", L.NewFunction(func(L *lua.LState) int {
+		userdata, err := constructStore(L)
+		if err != nil {
+			log.Error(err)
+			L.Push(lua.LString(err.Error()))
+			return 1 // number of results
+		}
+		L.Push(userdata)
+		return 1 // number of results
+	}))
+}